@@ -0,0 +1,135 @@
+// anomaly.go
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Anomaly is emitted whenever a sensor's EWMA control chart or CUSUM
+// change-point detector fires on a new reading.
+type Anomaly struct {
+	Sensor   string
+	Value    float64
+	Expected float64
+	ZScore   float64
+	Kind     string // "EWMA" or "CUSUM"
+	At       time.Time
+}
+
+const (
+	ewmaAlpha = 0.1 // smoothing factor for the EWMA control chart
+	ewmaK     = 3.0 // flag when |x - ewma| > ewmaK * sqrt(ewmv)
+
+	cusumKFactor = 0.5 // CUSUM slack, in multiples of the EWMA stddev
+	cusumHFactor = 5.0 // CUSUM alarm threshold, in multiples of the EWMA stddev
+)
+
+// anomalyState is the EWMA/CUSUM bookkeeping kept per sensor.
+type anomalyState struct {
+	mutex      sync.Mutex
+	hasValue   bool
+	ewma       float64
+	ewmv       float64
+	cusumPlus  float64
+	cusumMinus float64
+	alarmed    bool // true while a CUSUM alarm is in effect (see anomalyCountForMachine)
+}
+
+// anomalyStates holds every sensor's EWMA/CUSUM bookkeeping, sharded by
+// name (see shardedmap.go) so per-sensor anomaly tracking doesn't become
+// its own global-lock bottleneck.
+var anomalyStates = newShardedMap[anomalyState]()
+var anomalyFeed chan Anomaly
+
+func init() {
+	anomalyFeed = make(chan Anomaly, 256)
+}
+
+func getOrCreateAnomalyState(sensorName string) *anomalyState {
+	return anomalyStates.getOrCreate(sensorName, func() *anomalyState { return &anomalyState{} })
+}
+
+// DetectAnomaly folds a new reading into a sensor's EWMA control chart
+// and CUSUM change-point detector, publishing to AnomalyFeed() whenever
+// either one fires.
+func DetectAnomaly(sensorName string, value float64, at time.Time) {
+	state := getOrCreateAnomalyState(sensorName)
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if !state.hasValue {
+		state.ewma = value
+		state.ewmv = 0
+		state.hasValue = true
+		return
+	}
+
+	prevEwma := state.ewma
+	state.ewma = ewmaAlpha*value + (1-ewmaAlpha)*prevEwma
+	state.ewmv = ewmaAlpha*(value-prevEwma)*(value-prevEwma) + (1-ewmaAlpha)*state.ewmv
+
+	stdDev := math.Sqrt(state.ewmv)
+	if stdDev == 0 {
+		return
+	}
+
+	zScore := (value - prevEwma) / stdDev
+	if math.Abs(value-prevEwma) > ewmaK*stdDev {
+		emitAnomaly(Anomaly{Sensor: sensorName, Value: value, Expected: prevEwma, ZScore: zScore, Kind: "EWMA", At: at})
+	}
+
+	k := cusumKFactor * stdDev
+	h := cusumHFactor * stdDev
+	state.cusumPlus = math.Max(0, state.cusumPlus+(value-prevEwma-k))
+	state.cusumMinus = math.Min(0, state.cusumMinus+(value-prevEwma+k))
+
+	if state.cusumPlus > h || -state.cusumMinus > h {
+		emitAnomaly(Anomaly{Sensor: sensorName, Value: value, Expected: prevEwma, ZScore: zScore, Kind: "CUSUM", At: at})
+		state.cusumPlus = 0
+		state.cusumMinus = 0
+		state.alarmed = true
+	} else if state.cusumPlus == 0 && state.cusumMinus == 0 {
+		// Accumulators are back inside the band; the excursion is over.
+		state.alarmed = false
+	}
+}
+
+// emitAnomaly publishes without blocking the ingestion hot path; if
+// nobody is draining AnomalyFeed() fast enough, the anomaly is dropped
+// rather than stalling the consumer goroutine.
+func emitAnomaly(a Anomaly) {
+	select {
+	case anomalyFeed <- a:
+	default:
+	}
+}
+
+// AnomalyFeed returns the channel anomalies are published on. There is a
+// single shared feed for the process.
+func AnomalyFeed() <-chan Anomaly {
+	return anomalyFeed
+}
+
+// anomalyCountForMachine reports how many of a machine's sensors
+// currently have an alarmed CUSUM excursion, used as MachineTrend's
+// per-machine anomaly count. This tracks the explicit alarmed flag set
+// when |S| crosses h, not the accumulator's sign - ordinary drift pushes
+// cusumPlus/cusumMinus off zero constantly without ever alarming, and an
+// alarm resets both accumulators to zero the instant it fires.
+func anomalyCountForMachine(machineName string) int {
+	count := 0
+	belongsToMachine := func(sensorName string) bool {
+		return len(sensorName) > len(machineName) && sensorName[:len(machineName)] == machineName
+	}
+	anomalyStates.forEach(belongsToMachine, func(_ string, state *anomalyState) {
+		state.mutex.Lock()
+		if state.alarmed {
+			count++
+		}
+		state.mutex.Unlock()
+	})
+	return count
+}
@@ -3,7 +3,7 @@ package main
 
 import (
 	"math"
-	"sync"
+	"sort"
 	"time"
 )
 
@@ -19,14 +19,14 @@ type TrendAnalysis struct {
 	TimeToWarning   int     // Seconds until sensor enters warning zone (80%)
 	TimeToCritical  int     // Seconds until sensor exceeds limits
 	Confidence      string  // "HIGH", "MEDIUM", "LOW" based on R-squared
-}
 
-// SensorTrendData holds historical data for trend analysis
-type SensorTrendData struct {
-	Values     []float64
-	Timestamps []time.Time
-	MaxPoints  int
-	mutex      sync.RWMutex
+	// PredictionCI5Min is the two-sided 95% confidence interval around
+	// Prediction5Min: [low, high].
+	PredictionCI5Min [2]float64
+	StdDev           float64 // Standard deviation of the window
+	Median           float64 // Median of the window
+	P90              float64 // 90th percentile of the window
+	P99              float64 // 99th percentile of the window
 }
 
 // MachineTrend aggregates trends for all sensors on a machine
@@ -37,40 +37,25 @@ type MachineTrend struct {
 	SensorsAtRisk     int     // Number of sensors trending toward critical
 	EstimatedFailTime int     // Seconds until estimated failure (if degrading)
 	Confidence        string
+	AnomalyCount      int // Sensors with a live CUSUM excursion right now
 }
 
-var sensorTrends map[string]*SensorTrendData
-var trendMutex sync.RWMutex
+// defaultTrendWindow is the history window that printAverageReport and
+// AnalyzeMachineTrends pass to AnalyzeSensorTrend.
+const defaultTrendWindow = time.Hour
 
 func initAnalytics() {
-	sensorTrends = make(map[string]*SensorTrendData)
+	// Archive storage (storage.go) initializes itself; nothing to do here.
 }
 
-// AddDataPoint adds a new sensor reading to the trend analysis
+// AddDataPoint adds a new sensor reading to the RRD-backed trend
+// history. It used to also maintain an in-memory 100-point ring buffer,
+// but that cap is gone now that AnalyzeSensorTrend can pull however much
+// history it needs straight from the archives (see storage.go). It also
+// feeds the EWMA/CUSUM anomaly detector (see anomaly.go).
 func AddDataPoint(sensorName string, value float64, timestamp time.Time) {
-	trendMutex.Lock()
-	defer trendMutex.Unlock()
-
-	if sensorTrends[sensorName] == nil {
-		sensorTrends[sensorName] = &SensorTrendData{
-			Values:     make([]float64, 0, 100),
-			Timestamps: make([]time.Time, 0, 100),
-			MaxPoints:  100, // Keep last 100 points
-		}
-	}
-
-	trend := sensorTrends[sensorName]
-	trend.mutex.Lock()
-	defer trend.mutex.Unlock()
-
-	trend.Values = append(trend.Values, value)
-	trend.Timestamps = append(trend.Timestamps, timestamp)
-
-	// Keep only last MaxPoints
-	if len(trend.Values) > trend.MaxPoints {
-		trend.Values = trend.Values[1:]
-		trend.Timestamps = trend.Timestamps[1:]
-	}
+	RecordSample(sensorName, value, timestamp)
+	DetectAnomaly(sensorName, value, timestamp)
 }
 
 // CalculateLinearRegression performs least squares regression
@@ -110,29 +95,133 @@ func CalculateLinearRegression(x, y []float64) (slope, intercept, rSquared float
 	return slope, intercept, rSquared
 }
 
-// AnalyzeSensorTrend performs comprehensive trend analysis on a sensor
-func AnalyzeSensorTrend(sensorName string, limit OperationalLimit) *TrendAnalysis {
-	trendMutex.RLock()
-	trendData, exists := sensorTrends[sensorName]
-	trendMutex.RUnlock()
+// residualStandardError computes the regression's standard error (se)
+// along with Sxx and meanX, which callers need to build a prediction
+// interval at an arbitrary future x.
+func residualStandardError(x, y []float64, slope, intercept float64) (se, sxx, meanX float64) {
+	n := float64(len(x))
+	if n < 3 {
+		return 0, 0, 0
+	}
 
-	if !exists || trendData == nil {
-		return nil
+	var sumX, sumXX, ssResidual float64
+	for i := range x {
+		sumX += x[i]
+		sumXX += x[i] * x[i]
+		residual := y[i] - (slope*x[i] + intercept)
+		ssResidual += residual * residual
+	}
+
+	meanX = sumX / n
+	sxx = sumXX - sumX*sumX/n
+	se = math.Sqrt(ssResidual / (n - 2))
+	return se, sxx, meanX
+}
+
+// tQuantileApprox approximates the two-sided 95% t-quantile for df
+// degrees of freedom. For df > 30 the t-distribution is close enough to
+// normal that 1.96 is used directly; smaller df uses a small lookup
+// table of the standard 95% critical values.
+func tQuantileApprox(df int) float64 {
+	table := map[int]float64{
+		1: 12.706, 2: 4.303, 3: 3.182, 4: 2.776, 5: 2.571,
+		6: 2.447, 7: 2.365, 8: 2.306, 9: 2.262, 10: 2.228,
+		15: 2.131, 20: 2.086, 25: 2.060, 30: 2.042,
+	}
+
+	if df <= 0 {
+		return 1.96
+	}
+	if t, ok := table[df]; ok {
+		return t
+	}
+	if df > 30 {
+		return 1.96
 	}
 
-	trendData.mutex.RLock()
-	defer trendData.mutex.RUnlock()
+	// Fall back to the nearest tabulated df below this one.
+	best, bestDf := 1.96, 0
+	for d, t := range table {
+		if d < df && d > bestDf {
+			best, bestDf = t, d
+		}
+	}
+	return best
+}
+
+// robustStats computes the standard deviation, median, and nearest-rank
+// 90th/99th percentiles over a window of values.
+func robustStats(values []float64) (stdDev, median, p90, p99 float64) {
+	n := len(values)
+	if n == 0 {
+		return 0, 0, 0, 0
+	}
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(n)
 
-	if len(trendData.Values) < 3 {
+	var sumSq float64
+	for _, v := range values {
+		sumSq += (v - mean) * (v - mean)
+	}
+	stdDev = math.Sqrt(sumSq / float64(n))
+
+	sorted := make([]float64, n)
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	median = nearestRankPercentile(sorted, 50)
+	p90 = nearestRankPercentile(sorted, 90)
+	p99 = nearestRankPercentile(sorted, 99)
+	return stdDev, median, p90, p99
+}
+
+// nearestRankPercentile returns the p-th percentile of an already-sorted
+// slice using the nearest-rank method.
+func nearestRankPercentile(sorted []float64, p float64) float64 {
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(n))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= n {
+		rank = n - 1
+	}
+	return sorted[rank]
+}
+
+// AnalyzeSensorTrend performs comprehensive trend analysis on a sensor,
+// using up to `window` of history pulled from the RRD archive whose
+// resolution best fits that window (see storage.go). `now` anchors the
+// fetch window's end; callers pass time.Now() for a live consumer and
+// the replay's virtual clock when backtesting (see replay.go), since
+// historical readings were never recorded against the wall clock.
+func AnalyzeSensorTrend(sensorName string, limit OperationalLimit, window time.Duration, now time.Time) *TrendAnalysis {
+	end := now
+	start := end.Add(-window)
+
+	// Aim for roughly 300 consolidated points across the window.
+	step := window / 300
+	if step < time.Second {
+		step = time.Second
+	}
+
+	y, timestamps := Fetch(sensorName, CFAverage, start, end, step)
+	if len(y) < 3 {
 		return nil // Need at least 3 points for meaningful analysis
 	}
 
 	// Convert timestamps to seconds since first point
-	x := make([]float64, len(trendData.Timestamps))
-	y := trendData.Values
+	x := make([]float64, len(timestamps))
 
-	baseTime := trendData.Timestamps[0]
-	for i, t := range trendData.Timestamps {
+	baseTime := timestamps[0]
+	for i, t := range timestamps {
 		x[i] = t.Sub(baseTime).Seconds()
 	}
 
@@ -150,6 +239,18 @@ func AnalyzeSensorTrend(sensorName string, limit OperationalLimit) *TrendAnalysi
 	analysis.Prediction5Min = slope*(currentTime+300) + intercept
 	analysis.Prediction10Min = slope*(currentTime+600) + intercept
 
+	// Two-sided 95% confidence interval around the 5-minute prediction
+	se, sxx, meanX := residualStandardError(x, y, slope, intercept)
+	if sxx > 0 {
+		futureX := currentTime + 300
+		sePred := se * math.Sqrt(1+1/float64(len(x))+math.Pow(futureX-meanX, 2)/sxx)
+		margin := tQuantileApprox(len(x)-2) * sePred
+		analysis.PredictionCI5Min = [2]float64{analysis.Prediction5Min - margin, analysis.Prediction5Min + margin}
+	}
+
+	// Robust descriptive stats over the window
+	analysis.StdDev, analysis.Median, analysis.P90, analysis.P99 = robustStats(y)
+
 	// Determine trend direction
 	if math.Abs(slope) < 0.001 {
 		analysis.TrendDirection = "STABLE"
@@ -179,6 +280,36 @@ func AnalyzeSensorTrend(sensorName string, limit OperationalLimit) *TrendAnalysi
 		currentPercentage = 50
 	}
 
+	// Downgrade confidence if the 5-minute CI straddles both the
+	// direction-appropriate warning threshold and the current value -
+	// the regression can't actually distinguish "already at risk" from
+	// "comfortably within range" in that case.
+	if rangeSpan > 0 {
+		var warningThreshold float64
+		haveThreshold := false
+		if slope > 0 {
+			warningThreshold = limit.OperationalLow + rangeSpan*0.8
+			haveThreshold = true
+		} else if slope < 0 {
+			warningThreshold = limit.OperationalLow + rangeSpan*0.2
+			haveThreshold = true
+		}
+
+		if haveThreshold {
+			low, high := analysis.PredictionCI5Min[0], analysis.PredictionCI5Min[1]
+			spansThreshold := low <= warningThreshold && high >= warningThreshold
+			spansCurrent := low <= currentValue && high >= currentValue
+			if spansThreshold && spansCurrent {
+				switch analysis.Confidence {
+				case "HIGH":
+					analysis.Confidence = "MEDIUM"
+				case "MEDIUM":
+					analysis.Confidence = "LOW"
+				}
+			}
+		}
+	}
+
 	// Calculate health score (0-100)
 	// Best health: stable trend, value between 20-80%
 	healthScore := 100.0
@@ -233,32 +364,35 @@ func AnalyzeSensorTrend(sensorName string, limit OperationalLimit) *TrendAnalysi
 	return analysis
 }
 
-// AnalyzeMachineTrends aggregates sensor trends for a machine
-func AnalyzeMachineTrends(machineName string, machineStats *MachineStatus) *MachineTrend {
+// AnalyzeMachineTrends aggregates sensor trends for a machine. `now`
+// is forwarded to AnalyzeSensorTrend as the fetch window's end.
+func AnalyzeMachineTrends(machineName string, machineStats *MachineStatus, now time.Time) *MachineTrend {
 	// Get all sensors for this machine
 	var sensorAnalyses []*TrendAnalysis
 	var healthScores []float64
 	sensorsAtRisk := 0
 
-	trendMutex.RLock()
-	for sensorName := range sensorTrends {
-		// Check if sensor belongs to this machine
+	var candidateSensors []string
+	for _, sensorName := range KnownSensorNames() {
 		if len(sensorName) > len(machineName) && sensorName[:len(machineName)] == machineName {
-			if limit, exists := operationalLimits[sensorName]; exists {
-				analysis := AnalyzeSensorTrend(sensorName, limit)
-				if analysis != nil && analysis.Confidence != "LOW" {
-					sensorAnalyses = append(sensorAnalyses, analysis)
-					healthScores = append(healthScores, analysis.HealthScore)
-
-					// Check if sensor is at risk
-					if analysis.TimeToWarning > 0 && analysis.TimeToWarning < 600 {
-						sensorsAtRisk++
-					}
+			candidateSensors = append(candidateSensors, sensorName)
+		}
+	}
+
+	for _, sensorName := range candidateSensors {
+		if limit, exists := operationalLimits[sensorName]; exists {
+			analysis := AnalyzeSensorTrend(sensorName, limit, defaultTrendWindow, now)
+			if analysis != nil && analysis.Confidence != "LOW" {
+				sensorAnalyses = append(sensorAnalyses, analysis)
+				healthScores = append(healthScores, analysis.HealthScore)
+
+				// Check if sensor is at risk
+				if analysis.TimeToWarning > 0 && analysis.TimeToWarning < 600 {
+					sensorsAtRisk++
 				}
 			}
 		}
 	}
-	trendMutex.RUnlock()
 
 	if len(sensorAnalyses) == 0 {
 		return nil
@@ -267,6 +401,7 @@ func AnalyzeMachineTrends(machineName string, machineStats *MachineStatus) *Mach
 	machineTrend := &MachineTrend{
 		MachineName:   machineName,
 		SensorsAtRisk: sensorsAtRisk,
+		AnomalyCount:  anomalyCountForMachine(machineName),
 	}
 
 	// Calculate average health score
@@ -0,0 +1,267 @@
+// metrics.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	exportersFlag = flag.String("exporters", "json", "comma-separated list of exporters to enable: json,prometheus,influx")
+	metricsAddr   = flag.String("metrics-addr", ":9090", "listen address for the Prometheus /metrics endpoint")
+	influxOutPath = flag.String("influx-out", "metrics.influx", "output file for the InfluxDB line-protocol exporter")
+)
+
+// SensorMetric is a point-in-time snapshot of a single sensor, shared by
+// every Exporter so they all report the same numbers.
+type SensorMetric struct {
+	Name           string  `json:"name"`
+	Machine        string  `json:"machine"`
+	Current        float64 `json:"current"`
+	RollingMean    float64 `json:"rolling_mean"`
+	PercentOfRange float64 `json:"percent_of_range"`
+
+	// Trend fields, populated from AnalyzeSensorTrend when at least 3
+	// historical points are available; omitted from JSON otherwise.
+	// PredictionCI5Min is a pointer because omitempty has no effect on a
+	// fixed-size array - [2]float64{} is never "empty" to encoding/json -
+	// so a plain array would always serialize as [0,0] instead of being
+	// dropped.
+	PredictionCI5Min *[2]float64 `json:"prediction_ci_5min,omitempty"`
+	StdDev           float64     `json:"std_dev,omitempty"`
+	Median           float64     `json:"median,omitempty"`
+	P90              float64     `json:"p90,omitempty"`
+	P99              float64     `json:"p99,omitempty"`
+}
+
+// ReportSnapshot is handed to every registered Exporter once per 10-second
+// reporting window (see printAverageReport).
+type ReportSnapshot struct {
+	Timestamp time.Time
+	Sensors   []SensorMetric
+	Machines  map[string]MachineStatusJSON
+}
+
+// Exporter fans a ReportSnapshot out to some sink: a file, an HTTP
+// endpoint, a time-series database, etc. printAverageReport doesn't need
+// to know which exporters are active, only that they implement this.
+type Exporter interface {
+	Export(snapshot ReportSnapshot) error
+}
+
+// Counters for the Prometheus exporter and anyone else who wants them.
+var (
+	messagesConsumedTotal uint64
+	parseErrorsTotal      uint64
+	messagesNackedTotal   uint64
+)
+
+func incMessagesConsumed() { atomic.AddUint64(&messagesConsumedTotal, 1) }
+func incParseErrors()      { atomic.AddUint64(&parseErrorsTotal, 1) }
+func incMessagesNacked()   { atomic.AddUint64(&messagesNackedTotal, 1) }
+
+// rollingMeanAlpha controls how quickly the rolling mean gauge follows
+// each new 10-second window average.
+const rollingMeanAlpha = 0.2
+
+var (
+	rollingMeans      = make(map[string]float64)
+	rollingMeansMutex sync.Mutex
+)
+
+// updateRollingMean folds a new window average into the sensor's
+// exponentially smoothed rolling mean and returns the updated value.
+func updateRollingMean(sensorName string, value float64) float64 {
+	rollingMeansMutex.Lock()
+	defer rollingMeansMutex.Unlock()
+
+	prev, ok := rollingMeans[sensorName]
+	if !ok {
+		rollingMeans[sensorName] = value
+		return value
+	}
+
+	updated := rollingMeanAlpha*value + (1-rollingMeanAlpha)*prev
+	rollingMeans[sensorName] = updated
+	return updated
+}
+
+// JSONFileExporter reproduces the original behavior: a single
+// machine_status.json for the Streamlit dashboard. It also writes a
+// companion sensor_trends.json with per-sensor prediction bands, since
+// dashboards that want those shouldn't have to parse Prometheus text.
+type JSONFileExporter struct {
+	Path        string
+	SensorsPath string
+}
+
+func (e *JSONFileExporter) Export(snapshot ReportSnapshot) error {
+	data, err := json.MarshalIndent(snapshot.Machines, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal machine status: %w", err)
+	}
+
+	if err := os.WriteFile(e.Path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", e.Path, err)
+	}
+
+	if e.SensorsPath != "" {
+		sensorData, err := json.MarshalIndent(snapshot.Sensors, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal sensor trends: %w", err)
+		}
+		if err := os.WriteFile(e.SensorsPath, sensorData, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", e.SensorsPath, err)
+		}
+	}
+
+	return nil
+}
+
+// PrometheusExporter keeps the latest snapshot and serves it in
+// Prometheus text format from ServeHTTP on every scrape.
+type PrometheusExporter struct {
+	mu       sync.Mutex
+	snapshot ReportSnapshot
+}
+
+func newPrometheusExporter() *PrometheusExporter {
+	return &PrometheusExporter{}
+}
+
+func (e *PrometheusExporter) Export(snapshot ReportSnapshot) error {
+	e.mu.Lock()
+	e.snapshot = snapshot
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	snapshot := e.snapshot
+	e.mu.Unlock()
+
+	var b strings.Builder
+
+	writeGauge := func(name, help string, get func(SensorMetric) float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, s := range snapshot.Sensors {
+			fmt.Fprintf(&b, "%s{sensor=%q,machine=%q} %g\n", name, s.Name, s.Machine, get(s))
+		}
+	}
+
+	writeGauge("maelstrom_sensor_value", "Current sensor value for the last reporting window.",
+		func(s SensorMetric) float64 { return s.Current })
+	writeGauge("maelstrom_sensor_rolling_mean", "Exponentially smoothed sensor mean across windows.",
+		func(s SensorMetric) float64 { return s.RollingMean })
+	writeGauge("maelstrom_sensor_percent_of_range", "Sensor value as a percentage of its operational range.",
+		func(s SensorMetric) float64 { return s.PercentOfRange })
+
+	machines := make([]string, 0, len(snapshot.Machines))
+	for name := range snapshot.Machines {
+		machines = append(machines, name)
+	}
+	sort.Strings(machines)
+
+	fmt.Fprintf(&b, "# HELP maelstrom_machine_health_score Aggregate machine health score (0-100).\n# TYPE maelstrom_machine_health_score gauge\n")
+	for _, name := range machines {
+		fmt.Fprintf(&b, "maelstrom_machine_health_score{machine=%q} %g\n", name, snapshot.Machines[name].HealthScore)
+	}
+	fmt.Fprintf(&b, "# HELP maelstrom_machine_sensors_at_risk Sensors trending toward a critical threshold.\n# TYPE maelstrom_machine_sensors_at_risk gauge\n")
+	for _, name := range machines {
+		fmt.Fprintf(&b, "maelstrom_machine_sensors_at_risk{machine=%q} %d\n", name, snapshot.Machines[name].SensorsAtRisk)
+	}
+	fmt.Fprintf(&b, "# HELP maelstrom_machine_estimated_fail_seconds Estimated seconds until failure, 0 if unknown.\n# TYPE maelstrom_machine_estimated_fail_seconds gauge\n")
+	for _, name := range machines {
+		fmt.Fprintf(&b, "maelstrom_machine_estimated_fail_seconds{machine=%q} %d\n", name, snapshot.Machines[name].EstimatedFailTime)
+	}
+	fmt.Fprintf(&b, "# HELP maelstrom_machine_anomaly_count Sensors with a live CUSUM excursion.\n# TYPE maelstrom_machine_anomaly_count gauge\n")
+	for _, name := range machines {
+		fmt.Fprintf(&b, "maelstrom_machine_anomaly_count{machine=%q} %d\n", name, snapshot.Machines[name].AnomalyCount)
+	}
+
+	fmt.Fprintf(&b, "# HELP maelstrom_messages_consumed_total Messages consumed from the queue.\n# TYPE maelstrom_messages_consumed_total counter\nmaelstrom_messages_consumed_total %d\n", atomic.LoadUint64(&messagesConsumedTotal))
+	fmt.Fprintf(&b, "# HELP maelstrom_parse_errors_total Messages that failed to parse.\n# TYPE maelstrom_parse_errors_total counter\nmaelstrom_parse_errors_total %d\n", atomic.LoadUint64(&parseErrorsTotal))
+	fmt.Fprintf(&b, "# HELP maelstrom_messages_nacked_total Messages nacked back to the broker.\n# TYPE maelstrom_messages_nacked_total counter\nmaelstrom_messages_nacked_total %d\n", atomic.LoadUint64(&messagesNackedTotal))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String())
+}
+
+// Serve starts the /metrics HTTP endpoint. It runs for the lifetime of
+// the process, so callers should invoke it in its own goroutine.
+func (e *PrometheusExporter) Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	log.Printf("Prometheus metrics listening on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Warning: metrics server stopped: %s", err)
+	}
+}
+
+// InfluxExporter appends each snapshot to a file in InfluxDB line
+// protocol, so it can be loaded with `influx write` or inspected by hand.
+type InfluxExporter struct {
+	Path string
+}
+
+func (e *InfluxExporter) Export(snapshot ReportSnapshot) error {
+	file, err := os.OpenFile(e.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open influx output: %w", err)
+	}
+	defer file.Close()
+
+	ts := snapshot.Timestamp.UnixNano()
+	var b strings.Builder
+	for _, s := range snapshot.Sensors {
+		fmt.Fprintf(&b, "sensor,sensor=%s,machine=%s current=%g,rolling_mean=%g,percent_of_range=%g %d\n",
+			escapeInfluxTag(s.Name), escapeInfluxTag(s.Machine), s.Current, s.RollingMean, s.PercentOfRange, ts)
+	}
+	for name, m := range snapshot.Machines {
+		fmt.Fprintf(&b, "machine,machine=%s health_score=%g,sensors_at_risk=%di,estimated_fail_seconds=%di,anomaly_count=%di %d\n",
+			escapeInfluxTag(name), m.HealthScore, m.SensorsAtRisk, m.EstimatedFailTime, m.AnomalyCount, ts)
+	}
+
+	if _, err := file.WriteString(b.String()); err != nil {
+		return fmt.Errorf("failed to write influx output: %w", err)
+	}
+	return nil
+}
+
+func escapeInfluxTag(s string) string {
+	return strings.NewReplacer(" ", "\\ ", ",", "\\,", "=", "\\=").Replace(s)
+}
+
+// setupExporters builds the Exporter fan-out list from -exporters,
+// starting any background servers (Prometheus) it needs along the way.
+func setupExporters() []Exporter {
+	var result []Exporter
+	for _, name := range strings.Split(*exportersFlag, ",") {
+		switch strings.TrimSpace(name) {
+		case "json":
+			result = append(result, &JSONFileExporter{Path: "machine_status.json", SensorsPath: "sensor_trends.json"})
+		case "prometheus":
+			prom := newPrometheusExporter()
+			go prom.Serve(*metricsAddr)
+			result = append(result, prom)
+		case "influx":
+			result = append(result, &InfluxExporter{Path: *influxOutPath})
+		case "":
+			// allow trailing commas / empty flag without warning
+		default:
+			log.Printf("Warning: unknown exporter %q, skipping", name)
+		}
+	}
+	return result
+}
@@ -0,0 +1,405 @@
+// replay.go
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	sourceFlag = flag.String("source", "amqp", "where to read sensor readings from: amqp, csv:<path>, json:<path>, or rrd:<sensor>=<dumpfile>")
+	speedFlag  = flag.String("speed", "1", `replay speed multiplier against wall clock (e.g. "10"), or "asap" to run with no delay; ignored for --source=amqp`)
+)
+
+// Source produces SensorReadings for runReplay from one of the offline
+// replay sources. The live RabbitMQ path in main reads the queue directly
+// and does not go through Source. Next returns io.EOF once exhausted.
+type Source interface {
+	Next() (SensorReading, error)
+}
+
+// parseSource builds the Source named by a --source flag value.
+func parseSource(spec string) (Source, error) {
+	switch {
+	case strings.HasPrefix(spec, "csv:"):
+		return newCSVSource(strings.TrimPrefix(spec, "csv:"))
+	case strings.HasPrefix(spec, "json:"):
+		return newJSONSource(strings.TrimPrefix(spec, "json:"))
+	case strings.HasPrefix(spec, "rrd:"):
+		rest := strings.TrimPrefix(spec, "rrd:")
+		parts := strings.SplitN(rest, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("rrd source must be rrd:<sensor>=<dumpfile>, got %q", spec)
+		}
+		return newRRDDumpSource(parts[0], parts[1])
+	default:
+		return nil, fmt.Errorf("unknown --source %q", spec)
+	}
+}
+
+// CSVSource replays a CSV of historical readings with columns
+// timestamp,sensor,value. All rows sharing a timestamp, consecutive or
+// not, are grouped into a single SensorReading, mirroring the shape a live
+// message off the queue would have; readings are replayed in the order
+// each timestamp first appears.
+type CSVSource struct {
+	readings []SensorReading
+	pos      int
+}
+
+func newCSVSource(path string) (*CSVSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replay CSV: %w", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay CSV: %w", err)
+	}
+
+	var order []string
+	grouped := make(map[string]map[string]string)
+	for i := 1; i < len(records); i++ { // skip header
+		record := records[i]
+		if len(record) < 3 {
+			continue
+		}
+		timestamp, sensorName, value := record[0], record[1], record[2]
+		if _, exists := grouped[timestamp]; !exists {
+			grouped[timestamp] = make(map[string]string)
+			order = append(order, timestamp)
+		}
+		grouped[timestamp][sensorName] = value
+	}
+
+	readings := make([]SensorReading, 0, len(order))
+	for _, timestamp := range order {
+		readings = append(readings, SensorReading{Timestamp: timestamp, Readings: grouped[timestamp]})
+	}
+	return &CSVSource{readings: readings}, nil
+}
+
+func (s *CSVSource) Next() (SensorReading, error) {
+	if s.pos >= len(s.readings) {
+		return SensorReading{}, io.EOF
+	}
+	reading := s.readings[s.pos]
+	s.pos++
+	return reading, nil
+}
+
+// JSONSource replays a newline-delimited JSON file of SensorReading
+// objects, the same shape published to the live queue.
+type JSONSource struct {
+	file    *os.File
+	scanner *bufio.Scanner
+}
+
+func newJSONSource(path string) (*JSONSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replay JSON: %w", err)
+	}
+	return &JSONSource{file: file, scanner: bufio.NewScanner(file)}, nil
+}
+
+func (s *JSONSource) Next() (SensorReading, error) {
+	for s.scanner.Scan() {
+		line := strings.TrimSpace(s.scanner.Text())
+		if line == "" {
+			continue
+		}
+		var reading SensorReading
+		if err := json.Unmarshal([]byte(line), &reading); err != nil {
+			return SensorReading{}, fmt.Errorf("failed to parse replay JSON line: %w", err)
+		}
+		return reading, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return SensorReading{}, err
+	}
+	s.file.Close()
+	return SensorReading{}, io.EOF
+}
+
+// RRDDumpSource replays a single sensor's archive history from a CSV
+// produced by DumpCSV (timestamp,min,avg,max), feeding back its average
+// column so stored history can be re-run through analytics without a
+// live broker.
+type RRDDumpSource struct {
+	readings []SensorReading
+	pos      int
+}
+
+func newRRDDumpSource(sensorName, path string) (*RRDDumpSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open RRD dump: %w", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RRD dump: %w", err)
+	}
+
+	readings := make([]SensorReading, 0, len(records))
+	for i := 1; i < len(records); i++ { // skip the timestamp,min,avg,max header
+		record := records[i]
+		if len(record) < 4 {
+			continue
+		}
+		readings = append(readings, SensorReading{
+			Timestamp: record[0],
+			Readings:  map[string]string{sensorName: record[2]},
+		})
+	}
+	return &RRDDumpSource{readings: readings}, nil
+}
+
+func (s *RRDDumpSource) Next() (SensorReading, error) {
+	if s.pos >= len(s.readings) {
+		return SensorReading{}, io.EOF
+	}
+	reading := s.readings[s.pos]
+	s.pos++
+	return reading, nil
+}
+
+// parseReplaySpeed parses --speed: "asap" disables the virtual-clock
+// delay entirely, otherwise the value is a multiplier against wall clock
+// (e.g. "10" or "10x" replays ten times faster than the original cadence).
+func parseReplaySpeed(s string) (asap bool, multiplier float64, err error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "asap" {
+		return true, 0, nil
+	}
+
+	multiplier, err = strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || multiplier <= 0 {
+		return false, 0, fmt.Errorf("must be \"asap\" or a positive number, got %q", s)
+	}
+	return false, multiplier, nil
+}
+
+// virtualClock feeds replayed readings' own timestamps to AddDataPoint
+// and the report ticker, sleeping in real time between them (scaled by
+// the configured speed) so analytics see the same relative spacing a
+// live run would.
+type virtualClock struct {
+	asap       bool
+	multiplier float64
+	current    time.Time
+	hasTime    bool
+}
+
+func newVirtualClock(asap bool, multiplier float64) *virtualClock {
+	return &virtualClock{asap: asap, multiplier: multiplier}
+}
+
+// advance moves the clock to at, sleeping to preserve the configured
+// replay speed unless running --speed=asap.
+func (c *virtualClock) advance(at time.Time) {
+	if c.hasTime && !c.asap {
+		if delta := at.Sub(c.current); delta > 0 {
+			time.Sleep(time.Duration(float64(delta) / c.multiplier))
+		}
+	}
+	c.current = at
+	c.hasTime = true
+}
+
+func (c *virtualClock) now() time.Time {
+	if !c.hasTime {
+		return time.Now()
+	}
+	return c.current
+}
+
+// parseReadingTimestamp parses a SensorReading's Timestamp field,
+// falling back to "not available" rather than erroring so a malformed
+// timestamp can't abort an otherwise-good replay.
+func parseReadingTimestamp(s string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(int64(secs), 0), true
+	}
+	return time.Time{}, false
+}
+
+// sensorWarningState tracks one sensor's contiguous spans of time spent
+// above the 80% warning threshold, for the final replay summary.
+type sensorWarningState struct {
+	inWarning bool
+	start     time.Time
+	last      time.Time
+	durations []float64 // seconds, one per closed episode
+}
+
+// warningEpisodeTracker accumulates per-sensor time-in-warning episodes
+// across a replay run.
+type warningEpisodeTracker struct {
+	sensors map[string]*sensorWarningState
+}
+
+func newWarningTracker() *warningEpisodeTracker {
+	return &warningEpisodeTracker{sensors: make(map[string]*sensorWarningState)}
+}
+
+func (t *warningEpisodeTracker) observe(reading SensorReading, at time.Time) {
+	for sensorName, valueStr := range reading.Readings {
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			continue
+		}
+		limit, exists := operationalLimits[sensorName]
+		if !exists {
+			continue
+		}
+		rangeSpan := limit.OperationalHigh - limit.OperationalLow
+		if rangeSpan <= 0 {
+			continue
+		}
+		percentage := ((value - limit.OperationalLow) / rangeSpan) * 100
+
+		state, exists := t.sensors[sensorName]
+		if !exists {
+			state = &sensorWarningState{}
+			t.sensors[sensorName] = state
+		}
+
+		if percentage > 80 {
+			if !state.inWarning {
+				state.start = at
+				state.inWarning = true
+			}
+			state.last = at
+		} else if state.inWarning {
+			state.durations = append(state.durations, state.last.Sub(state.start).Seconds())
+			state.inWarning = false
+		}
+	}
+}
+
+// finalize closes out any warning episode still open at the end of a run.
+func (t *warningEpisodeTracker) finalize() {
+	for _, state := range t.sensors {
+		if state.inWarning {
+			state.durations = append(state.durations, state.last.Sub(state.start).Seconds())
+			state.inWarning = false
+		}
+	}
+}
+
+// durationStats computes min/mean/max and nearest-rank p50/p90/p99 over
+// a set of episode durations.
+func durationStats(values []float64) (min, mean, max, p50, p90, p99 float64) {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	min, max = sorted[0], sorted[len(sorted)-1]
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	mean = sum / float64(len(sorted))
+
+	p50 = nearestRankPercentile(sorted, 50)
+	p90 = nearestRankPercentile(sorted, 90)
+	p99 = nearestRankPercentile(sorted, 99)
+	return min, mean, max, p50, p90, p99
+}
+
+// printSummary prints the final benchmark-style replay report: per-sensor
+// time-in-warning statistics and the total wall-clock run time.
+func (t *warningEpisodeTracker) printSummary(wallElapsed time.Duration, messageCount int) {
+	t.finalize()
+
+	fmt.Printf("\n=== REPLAY SUMMARY ===\n")
+	fmt.Println("  " + strings.Repeat("=", 130))
+	fmt.Printf("  %-45s %8s %8s %8s %8s %8s %8s  (seconds in warning, per episode)\n",
+		"Sensor", "Min", "Mean", "Max", "p50", "p90", "p99")
+
+	names := make([]string, 0, len(t.sensors))
+	for name := range t.sensors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		durations := t.sensors[name].durations
+		if len(durations) == 0 {
+			continue
+		}
+		min, mean, max, p50, p90, p99 := durationStats(durations)
+		fmt.Printf("  %-45s %8.1f %8.1f %8.1f %8.1f %8.1f %8.1f\n", name, min, mean, max, p50, p90, p99)
+	}
+
+	fmt.Println("  " + strings.Repeat("=", 130))
+	fmt.Printf("  Messages replayed: %d | Wall time: %s\n", messageCount, wallElapsed.Round(time.Millisecond))
+	fmt.Println()
+}
+
+// runReplay drives the consumer pipeline from a Source instead of the
+// live RabbitMQ queue, using a virtualClock so AddDataPoint and the
+// 10-second report cadence see the same relative spacing a live run
+// would, then prints a final summary.
+func runReplay(source Source, asap bool, speedMultiplier float64) {
+	clock := newVirtualClock(asap, speedMultiplier)
+	tracker := newWarningTracker()
+	wallStart := time.Now()
+
+	var lastReport time.Time
+	hasLastReport := false
+	messageCount := 0
+
+	for {
+		reading, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading from replay source: %s", err)
+			incParseErrors()
+			continue
+		}
+
+		at, ok := parseReadingTimestamp(reading.Timestamp)
+		if !ok {
+			at = clock.now()
+		}
+		clock.advance(at)
+
+		addReadingToAggregate(reading, clock.now())
+		tracker.observe(reading, clock.now())
+		messageCount++
+		incMessagesConsumed()
+
+		if !hasLastReport {
+			lastReport = clock.now()
+			hasLastReport = true
+		} else if clock.now().Sub(lastReport) >= 10*time.Second {
+			printAverageReport(clock.now())
+			lastReport = clock.now()
+		}
+	}
+
+	printAverageReport(clock.now())
+
+	tracker.printSummary(time.Since(wallStart), messageCount)
+}
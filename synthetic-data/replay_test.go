@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAnalyzeSensorTrendUsesReplayClock guards against regressing to
+// time.Now() inside the trend fetch window: replaying readings dated
+// long before "now" must still produce a trend when the caller passes
+// the data's own clock, the way runReplay does.
+func TestAnalyzeSensorTrendUsesReplayClock(t *testing.T) {
+	const sensorName = "REPLAY-TEST:temp"
+	limit := OperationalLimit{SensorName: sensorName, OperationalHigh: 100, OperationalLow: 0}
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		at := base.Add(time.Duration(i) * time.Second)
+		AddDataPoint(sensorName, 50+float64(i), at)
+	}
+	replayNow := base.Add(19 * time.Second)
+
+	if trend := AnalyzeSensorTrend(sensorName, limit, time.Minute, replayNow); trend == nil {
+		t.Fatal("AnalyzeSensorTrend returned nil when given the replayed data's own clock")
+	}
+
+	if trend := AnalyzeSensorTrend(sensorName, limit, time.Minute, time.Now()); trend != nil {
+		t.Fatal("AnalyzeSensorTrend should find nothing for a historical sensor when anchored to the wall clock")
+	}
+}
@@ -0,0 +1,100 @@
+// shardedmap.go
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// shardCount is the fan-out used by every per-sensor sharded map in this
+// package, so sensors on different shards never contend for the same
+// lock. Factored out after the RRD store (storage.go) and the anomaly
+// detector (anomaly.go) had each grown their own copy of this discipline.
+const shardCount = 16
+
+// shardedMap is a fixed fan-out map[string]*V, each shard guarded by its
+// own RWMutex, with double-checked get-or-create.
+type shardedMap[V any] struct {
+	shards [shardCount]struct {
+		mutex sync.RWMutex
+		items map[string]*V
+	}
+}
+
+func newShardedMap[V any]() *shardedMap[V] {
+	m := &shardedMap[V]{}
+	for i := range m.shards {
+		m.shards[i].items = make(map[string]*V)
+	}
+	return m
+}
+
+func (m *shardedMap[V]) shardFor(key string) *struct {
+	mutex sync.RWMutex
+	items map[string]*V
+} {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &m.shards[h.Sum32()%shardCount]
+}
+
+// getOrCreate returns the existing entry for key, or calls create and
+// stores its result if none exists yet.
+func (m *shardedMap[V]) getOrCreate(key string, create func() *V) *V {
+	shard := m.shardFor(key)
+
+	shard.mutex.RLock()
+	v, exists := shard.items[key]
+	shard.mutex.RUnlock()
+	if exists {
+		return v
+	}
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if v, exists := shard.items[key]; exists {
+		return v
+	}
+	v = create()
+	shard.items[key] = v
+	return v
+}
+
+// get returns the entry for key, if any.
+func (m *shardedMap[V]) get(key string) (*V, bool) {
+	shard := m.shardFor(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	v, ok := shard.items[key]
+	return v, ok
+}
+
+// keys returns every key currently stored, gathered shard-by-shard so no
+// single lock is held for long.
+func (m *shardedMap[V]) keys() []string {
+	var keys []string
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mutex.RLock()
+		for k := range shard.items {
+			keys = append(keys, k)
+		}
+		shard.mutex.RUnlock()
+	}
+	return keys
+}
+
+// forEach calls fn for every entry whose key matches predicate, gathered
+// shard-by-shard so no single lock is held for long.
+func (m *shardedMap[V]) forEach(predicate func(key string) bool, fn func(key string, v *V)) {
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mutex.RLock()
+		for k, v := range shard.items {
+			if predicate(k) {
+				fn(k, v)
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+}
@@ -0,0 +1,272 @@
+// storage.go
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ArchiveSpec mirrors an RRDtool RRA: a step duration and how many
+// consolidated points of that step to retain.
+type ArchiveSpec struct {
+	Step  time.Duration
+	Count int
+}
+
+// defaultArchives is the resolution ladder kept for every sensor: raw
+// 1-second points for 10 minutes, then progressively coarser archives
+// reaching back a week. This replaces the old 100-sample in-memory cap.
+var defaultArchives = []ArchiveSpec{
+	{Step: time.Second, Count: 600},       // 10 minutes of raw data
+	{Step: 10 * time.Second, Count: 360},  // 1 hour
+	{Step: time.Minute, Count: 1440},      // 1 day
+	{Step: 10 * time.Minute, Count: 1008}, // 1 week
+}
+
+// ConsolidationFunc selects which of an archive's min/avg/max to read.
+type ConsolidationFunc string
+
+const (
+	CFAverage ConsolidationFunc = "AVERAGE"
+	CFMin     ConsolidationFunc = "MIN"
+	CFMax     ConsolidationFunc = "MAX"
+)
+
+// ConsolidatedPoint is one slot of an archive: the min/avg/max of every
+// raw sample that landed in its interval.
+type ConsolidatedPoint struct {
+	Time time.Time
+	Min  float64
+	Avg  float64
+	Max  float64
+	n    int // raw samples folded into this point so far
+}
+
+// archive is one resolution level of a sensor's RRD: a ring of
+// ConsolidatedPoints plus the in-progress point being accumulated.
+type archive struct {
+	spec     ArchiveSpec
+	points   []ConsolidatedPoint // ring buffer, length == spec.Count
+	writeIdx int
+	filled   int
+
+	current      ConsolidatedPoint
+	currentStart time.Time
+	hasCurrent   bool
+}
+
+func newArchive(spec ArchiveSpec) *archive {
+	return &archive{spec: spec, points: make([]ConsolidatedPoint, spec.Count)}
+}
+
+// add folds a raw value into the archive, rolling the in-progress point
+// into the ring buffer whenever its interval closes.
+func (a *archive) add(value float64, at time.Time) {
+	intervalStart := at.Truncate(a.spec.Step)
+
+	if a.hasCurrent && !intervalStart.Equal(a.currentStart) {
+		a.commit()
+	}
+
+	if !a.hasCurrent {
+		a.currentStart = intervalStart
+		a.current = ConsolidatedPoint{Time: intervalStart, Min: value, Avg: value, Max: value}
+		a.hasCurrent = true
+	}
+
+	c := &a.current
+	if value < c.Min {
+		c.Min = value
+	}
+	if value > c.Max {
+		c.Max = value
+	}
+	c.Avg = (c.Avg*float64(c.n) + value) / float64(c.n+1)
+	c.n++
+}
+
+// commit rolls the in-progress point into the ring buffer.
+func (a *archive) commit() {
+	a.points[a.writeIdx] = a.current
+	a.writeIdx = (a.writeIdx + 1) % len(a.points)
+	if a.filled < len(a.points) {
+		a.filled++
+	}
+	a.hasCurrent = false
+}
+
+// ordered returns committed points oldest-to-newest, optionally
+// including the in-progress point.
+func (a *archive) ordered(includeCurrent bool) []ConsolidatedPoint {
+	result := make([]ConsolidatedPoint, 0, a.filled+1)
+	start := (a.writeIdx - a.filled + len(a.points)) % len(a.points)
+	for i := 0; i < a.filled; i++ {
+		idx := (start + i) % len(a.points)
+		result = append(result, a.points[idx])
+	}
+	if includeCurrent && a.hasCurrent {
+		result = append(result, a.current)
+	}
+	return result
+}
+
+// bestArchive returns the coarsest archive whose step is <= the
+// requested step, falling back to the finest archive if none qualify.
+// Callers must hold the owning RRD's mutex.
+func bestArchive(archives []*archive, step time.Duration) *archive {
+	var best *archive
+	for _, a := range archives {
+		if a.spec.Step <= step {
+			if best == nil || a.spec.Step > best.spec.Step {
+				best = a
+			}
+		}
+	}
+	if best == nil && len(archives) > 0 {
+		best = archives[0]
+	}
+	return best
+}
+
+// RRD is one sensor's multi-resolution history, modeled after RRDtool.
+type RRD struct {
+	mutex      sync.RWMutex
+	archives   []*archive
+	lastUpdate time.Time
+}
+
+func newRRD() *RRD {
+	archives := make([]*archive, len(defaultArchives))
+	for i, spec := range defaultArchives {
+		archives[i] = newArchive(spec)
+	}
+	return &RRD{archives: archives}
+}
+
+// rrdStore holds every sensor's RRD, sharded by name (see shardedmap.go)
+// so sensors on different shards never contend for the same lock.
+var rrdStore = newShardedMap[RRD]()
+
+// RecordSample feeds a raw reading into every archive of a sensor's RRD,
+// creating the RRD on first use.
+func RecordSample(sensorName string, value float64, at time.Time) {
+	rrd := rrdStore.getOrCreate(sensorName, newRRD)
+
+	rrd.mutex.Lock()
+	defer rrd.mutex.Unlock()
+	for _, a := range rrd.archives {
+		a.add(value, at)
+	}
+	rrd.lastUpdate = at
+}
+
+func lookupRRD(sensorName string) *RRD {
+	rrd, _ := rrdStore.get(sensorName)
+	return rrd
+}
+
+// KnownSensorNames returns every sensor with RRD history.
+func KnownSensorNames() []string {
+	return rrdStore.keys()
+}
+
+// Fetch returns the values and timestamps of a sensor's archive whose
+// step is closest to (but not coarser than) the requested step, or the
+// finest archive when every step is coarser, limited to [start, end] and
+// consolidated with cf. Modeled after RRDtool's fetch.
+func Fetch(sensorName string, cf ConsolidationFunc, start, end time.Time, step time.Duration) ([]float64, []time.Time) {
+	rrd := lookupRRD(sensorName)
+	if rrd == nil {
+		return nil, nil
+	}
+
+	rrd.mutex.RLock()
+	defer rrd.mutex.RUnlock()
+
+	a := bestArchive(rrd.archives, step)
+	if a == nil {
+		return nil, nil
+	}
+
+	var values []float64
+	var timestamps []time.Time
+	for _, p := range a.ordered(true) {
+		if p.Time.Before(start) || p.Time.After(end) {
+			continue
+		}
+		switch cf {
+		case CFMin:
+			values = append(values, p.Min)
+		case CFMax:
+			values = append(values, p.Max)
+		default:
+			values = append(values, p.Avg)
+		}
+		timestamps = append(timestamps, p.Time)
+	}
+	return values, timestamps
+}
+
+// Info reports a sensor's RRD metadata, modeled after `rrdtool info`:
+// last update time and the shape of each archive.
+func Info(sensorName string) map[string]interface{} {
+	rrd := lookupRRD(sensorName)
+	if rrd == nil {
+		return nil
+	}
+
+	rrd.mutex.RLock()
+	defer rrd.mutex.RUnlock()
+
+	archivesInfo := make([]map[string]interface{}, len(rrd.archives))
+	for i, a := range rrd.archives {
+		archivesInfo[i] = map[string]interface{}{
+			"step":   a.spec.Step.String(),
+			"count":  a.spec.Count,
+			"filled": a.filled,
+		}
+	}
+
+	return map[string]interface{}{
+		"last_update": rrd.lastUpdate,
+		"archives":    archivesInfo,
+	}
+}
+
+// DumpCSV writes one archive's consolidated points as CSV:
+// timestamp,min,avg,max.
+func DumpCSV(sensorName string, archiveIndex int, w io.Writer) error {
+	rrd := lookupRRD(sensorName)
+	if rrd == nil {
+		return fmt.Errorf("no RRD data for sensor %q", sensorName)
+	}
+
+	rrd.mutex.RLock()
+	defer rrd.mutex.RUnlock()
+
+	if archiveIndex < 0 || archiveIndex >= len(rrd.archives) {
+		return fmt.Errorf("archive index %d out of range (have %d archives)", archiveIndex, len(rrd.archives))
+	}
+
+	writer := csv.NewWriter(w)
+	defer writer.Flush()
+
+	if err := writer.Write([]string{"timestamp", "min", "avg", "max"}); err != nil {
+		return err
+	}
+	for _, p := range rrd.archives[archiveIndex].ordered(true) {
+		record := []string{
+			p.Time.Format(time.RFC3339),
+			fmt.Sprintf("%g", p.Min),
+			fmt.Sprintf("%g", p.Avg),
+			fmt.Sprintf("%g", p.Max),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}